@@ -18,8 +18,14 @@ package storage
 
 import (
 	"fmt"
+	"io/ioutil"
+	mathrand "math/rand"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -27,6 +33,9 @@ import (
 	storageV1 "k8s.io/api/storage/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	k8stypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/rand"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/wait"
 	clientset "k8s.io/client-go/kubernetes"
 	"k8s.io/kubernetes/pkg/cloudprovider/providers/vsphere"
 	"k8s.io/kubernetes/test/e2e/framework"
@@ -41,33 +50,334 @@ import (
 	3. Launch VCP_SCALE_INSTANCES goroutine for creating VCP_SCALE_VOLUME_COUNT volumes. Each goroutine is responsible for create/attach of VCP_SCALE_VOLUME_COUNT/VCP_SCALE_INSTANCES volumes.
 	4. Read VCP_SCALE_VOLUMES_PER_POD from System Environment. Each pod will be have VCP_SCALE_VOLUMES_PER_POD attached to it.
 	5. Once all the go routines are completed, we delete all the pods and volumes.
+
+	Steps 1 and 5 are performed through a ScaleDriver, which abstracts away the
+	provider-specific details of building storage classes, resolving a bound
+	PV's volume handle, and confirming attach/detach state. Setting
+	VCP_SCALE_USE_CSI=true switches from the default in-tree vSphere volume
+	plugin driver to a generic CSI driver, named by VCP_SCALE_CSI_DRIVER_NAME
+	(defaulting to the vSphere CSI driver, provisioner "csi.vsphere.vmware.com"),
+	so the same harness can validate any CSI driver at scale.
 */
 const (
 	NodeLabelKey = "vsphere_e2e_label"
 )
 
+// vsphereCSIDriverName is the vSphere CSI driver's provisioner name.
+const vsphereCSIDriverName = "csi.vsphere.vmware.com"
+
+// csiAttachLimitKeyPrefix prefixes the Node.Status.Allocatable key a CSI
+// driver uses to advertise its per-node attach limit, e.g. "attachable-volumes-csi-csi.vsphere.vmware.com".
+const csiAttachLimitKeyPrefix = "attachable-volumes-csi-"
+
+// vSphere CSI driver parameter names, used in place of the in-tree plugin's when VCP_SCALE_USE_CSI is set.
+const (
+	CSIStoragePolicyName           = "storagepolicyname"
+	CSIDatastoreURL                = "datastoreurl"
+	CSIHostFailuresToTolerateParam = "hostfailurestotolerate-migrationparam"
+)
+
+// diskDetachPollTime and diskDetachTimeout bound a ScaleDriver's detach poll.
+const (
+	diskDetachPollTime = 5 * time.Second
+	diskDetachTimeout  = 5 * time.Minute
+)
+
+// ScaleDriver abstracts the provider-specific parts of the scale harness so VolumeCreateAndAttach can target any block storage provider.
+type ScaleDriver interface {
+	// BuildStorageClasses returns a StorageClass spec for each name in scNames.
+	BuildStorageClasses(scNames []string) []*storageV1.StorageClass
+	// ResolveVolumeHandle returns the identifier used to track pv's attach state.
+	ResolveVolumeHandle(pv *v1.PersistentVolume) string
+	// WaitForDisksDetached blocks until every volume in nodeVolumeMap has detached from its node.
+	WaitForDisksDetached(nodeVolumeMap map[k8stypes.NodeName][]string) error
+	// MaxVolumesPerNode returns how many volumes the driver can attach to node.
+	MaxVolumesPerNode(node *v1.Node) int
+	// VerifyVolumesAccessible asserts that persistentvolumes are mounted and usable inside pod.
+	VerifyVolumesAccessible(pod *v1.Pod, persistentvolumes []*v1.PersistentVolume)
+}
+
+// vsphereInTreeDriver is the ScaleDriver for the in-tree vSphere volume plugin.
+type vsphereInTreeDriver struct {
+	vsp           *vsphere.VSphere
+	policyName    string
+	datastoreName string
+}
+
+func (d *vsphereInTreeDriver) BuildStorageClasses(scNames []string) []*storageV1.StorageClass {
+	scArrays := make([]*storageV1.StorageClass, len(scNames))
+	for index, scname := range scNames {
+		var scParams map[string]string
+		switch scname {
+		case storageclass2:
+			scParams = map[string]string{Policy_HostFailuresToTolerate: "1"}
+		case storageclass3:
+			scParams = map[string]string{SpbmStoragePolicy: d.policyName}
+		case storageclass4:
+			scParams = map[string]string{Datastore: d.datastoreName}
+		}
+		scArrays[index] = getVSphereStorageClassSpec(scname, scParams)
+	}
+	return scArrays
+}
+
+func (d *vsphereInTreeDriver) ResolveVolumeHandle(pv *v1.PersistentVolume) string {
+	return pv.Spec.VsphereVolume.VolumePath
+}
+
+func (d *vsphereInTreeDriver) WaitForDisksDetached(nodeVolumeMap map[k8stypes.NodeName][]string) error {
+	return waitForVSphereDisksToDetach(d.vsp, nodeVolumeMap)
+}
+
+func (d *vsphereInTreeDriver) MaxVolumesPerNode(node *v1.Node) int {
+	return volumesPerNode
+}
+
+func (d *vsphereInTreeDriver) VerifyVolumesAccessible(pod *v1.Pod, persistentvolumes []*v1.PersistentVolume) {
+	verifyVSphereVolumesAccessible(pod, persistentvolumes, d.vsp)
+}
+
+// genericCSIDriver is a ScaleDriver usable with any CSI driver, named by driverName.
+type genericCSIDriver struct {
+	client       clientset.Interface
+	driverName   string
+	scParameters map[string]map[string]string
+}
+
+// newGenericCSIDriver builds a genericCSIDriver for driverName.
+func newGenericCSIDriver(client clientset.Interface, driverName, policyName, datastoreName string) *genericCSIDriver {
+	return &genericCSIDriver{
+		client:     client,
+		driverName: driverName,
+		scParameters: map[string]map[string]string{
+			storageclass2: {CSIHostFailuresToTolerateParam: "1"},
+			storageclass3: {CSIStoragePolicyName: policyName},
+			storageclass4: {CSIDatastoreURL: datastoreName},
+		},
+	}
+}
+
+func (d *genericCSIDriver) BuildStorageClasses(scNames []string) []*storageV1.StorageClass {
+	scArrays := make([]*storageV1.StorageClass, len(scNames))
+	for index, scname := range scNames {
+		scArrays[index] = &storageV1.StorageClass{
+			ObjectMeta:  metav1.ObjectMeta{Name: scname},
+			Provisioner: d.driverName,
+			Parameters:  d.scParameters[scname],
+		}
+	}
+	return scArrays
+}
+
+func (d *genericCSIDriver) ResolveVolumeHandle(pv *v1.PersistentVolume) string {
+	if pv.Spec.CSI != nil {
+		return pv.Spec.CSI.VolumeHandle
+	}
+	return pv.Spec.VsphereVolume.VolumePath
+}
+
+// WaitForDisksDetached polls VolumeAttachments until nodeVolumeMap's volumes are gone, special-casing the vSphere CSI driver to poll CNS/FCD directly.
+func (d *genericCSIDriver) WaitForDisksDetached(nodeVolumeMap map[k8stypes.NodeName][]string) error {
+	if d.driverName == vsphereCSIDriverName {
+		vsp, err := vsphere.GetVSphere()
+		if err != nil {
+			return err
+		}
+		return waitForVSphereCSIDisksToDetach(vsp, nodeVolumeMap)
+	}
+	return wait.Poll(diskDetachPollTime, diskDetachTimeout, func() (bool, error) {
+		attachments, err := d.client.StorageV1().VolumeAttachments().List(metav1.ListOptions{})
+		if err != nil {
+			return false, err
+		}
+		for _, va := range attachments.Items {
+			if va.Spec.Attacher != d.driverName {
+				continue
+			}
+			volumeIDs, ok := nodeVolumeMap[k8stypes.NodeName(va.Spec.NodeName)]
+			if !ok || va.Spec.Source.PersistentVolumeName == nil {
+				continue
+			}
+			pv, err := d.client.CoreV1().PersistentVolumes().Get(*va.Spec.Source.PersistentVolumeName, metav1.GetOptions{})
+			if err != nil {
+				continue
+			}
+			if pv.Spec.CSI == nil {
+				continue
+			}
+			for _, volumeID := range volumeIDs {
+				if volumeID == pv.Spec.CSI.VolumeHandle {
+					return false, nil
+				}
+			}
+		}
+		return true, nil
+	})
+}
+
+// MaxVolumesPerNode prefers the node's allocatable attach-limit resource, falling back to its CSINode driver entry.
+func (d *genericCSIDriver) MaxVolumesPerNode(node *v1.Node) int {
+	csiAttachLimitKey := v1.ResourceName(csiAttachLimitKeyPrefix + d.driverName)
+	if limit, ok := node.Status.Allocatable[csiAttachLimitKey]; ok {
+		return int(limit.Value())
+	}
+	csiNode, err := d.client.StorageV1beta1().CSINodes().Get(node.Name, metav1.GetOptions{})
+	if err != nil {
+		framework.Logf("MaxVolumesPerNode: failed to get CSINode %q: %v", node.Name, err)
+		return 0
+	}
+	for _, driver := range csiNode.Spec.Drivers {
+		if driver.Name == d.driverName && driver.Allocatable != nil && driver.Allocatable.Count != nil {
+			return int(*driver.Allocatable.Count)
+		}
+	}
+	framework.Logf("MaxVolumesPerNode: CSINode %q has no allocatable count for driver %q", node.Name, d.driverName)
+	return 0
+}
+
+func (d *genericCSIDriver) VerifyVolumesAccessible(pod *v1.Pod, persistentvolumes []*v1.PersistentVolume) {
+	for _, mount := range pod.Spec.Containers[0].VolumeMounts {
+		_, err := framework.RunKubectl("exec", pod.Name, fmt.Sprintf("--namespace=%s", pod.Namespace), "--", "ls", mount.MountPath)
+		Expect(err).NotTo(HaveOccurred())
+	}
+}
+
+// newScaleDriver picks the in-tree vSphere driver, or a generic CSI driver named by VCP_SCALE_CSI_DRIVER_NAME when useCSIDriver is set.
+func newScaleDriver(client clientset.Interface, useCSIDriver bool, policyName, datastoreName string) (ScaleDriver, error) {
+	if !useCSIDriver {
+		vsp, err := vsphere.GetVSphere()
+		if err != nil {
+			return nil, err
+		}
+		return &vsphereInTreeDriver{vsp: vsp, policyName: policyName, datastoreName: datastoreName}, nil
+	}
+	driverName := os.Getenv("VCP_SCALE_CSI_DRIVER_NAME")
+	if driverName == "" {
+		driverName = vsphereCSIDriverName
+	}
+	return newGenericCSIDriver(client, driverName, policyName, datastoreName), nil
+}
+
+// waitForVSphereCSIDisksToDetach polls CNS until none of the given FCDs are still attached to their node.
+func waitForVSphereCSIDisksToDetach(vsp *vsphere.VSphere, nodeVolumeMap map[k8stypes.NodeName][]string) error {
+	return wait.Poll(diskDetachPollTime, diskDetachTimeout, func() (bool, error) {
+		for nodeName, fcdIDs := range nodeVolumeMap {
+			for _, fcdID := range fcdIDs {
+				attached, err := vsp.IsFCDAttached(fcdID, string(nodeName))
+				if err != nil {
+					return false, err
+				}
+				if attached {
+					return false, nil
+				}
+			}
+		}
+		return true, nil
+	})
+}
+
 // NodeSelector holds
 type NodeSelector struct {
 	labelKey   string
 	labelValue string
+	nodeName   string
+}
+
+// volumeAttachID mirrors the scheduler's CSIMaxVolumeLimitChecker identity: provisioner+volume handle, or provisioner+random+PVC UID for non-CSI volumes.
+func volumeAttachID(provisioner string, pv *v1.PersistentVolume, volumeHandle string, pvcUID k8stypes.UID) string {
+	if pv.Spec.CSI != nil {
+		return fmt.Sprintf("%s/%s", provisioner, volumeHandle)
+	}
+	return fmt.Sprintf("%s/%s-%s", provisioner, rand.String(32), pvcUID)
+}
+
+// nodeVolumeLimitTracker enforces each node's real attach limit across goroutines.
+type nodeVolumeLimitTracker struct {
+	mutex    sync.Mutex
+	limits   map[string]int
+	attached map[string]map[string]bool
+}
+
+func newNodeVolumeLimitTracker(nodes *v1.NodeList, driver ScaleDriver) *nodeVolumeLimitTracker {
+	tracker := &nodeVolumeLimitTracker{
+		limits:   make(map[string]int),
+		attached: make(map[string]map[string]bool),
+	}
+	for i := range nodes.Items {
+		node := &nodes.Items[i]
+		tracker.limits[node.Name] = driver.MaxVolumesPerNode(node)
+		tracker.attached[node.Name] = make(map[string]bool)
+	}
+	return tracker
+}
+
+// totalCapacity sums the real per-node attach limits.
+func (t *nodeVolumeLimitTracker) totalCapacity() int {
+	total := 0
+	for _, limit := range t.limits {
+		total += limit
+	}
+	return total
+}
+
+// reserveBatch atomically reserves n free slots on nodeName, so a whole
+// pod's worth of volumes can never be split by a concurrent goroutine
+// between the capacity check and the actual attach. It returns a
+// placeholder ID per reserved slot, to be swapped for the volume's real
+// attach ID via finalize once it's known.
+func (t *nodeVolumeLimitTracker) reserveBatch(nodeName string, n int) ([]string, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if len(t.attached[nodeName])+n > t.limits[nodeName] {
+		return nil, false
+	}
+	placeholders := make([]string, n)
+	for i := 0; i < n; i++ {
+		placeholders[i] = fmt.Sprintf("pending/%s/%d", nodeName, len(t.attached[nodeName]))
+		t.attached[nodeName][placeholders[i]] = true
+	}
+	return placeholders, true
+}
+
+// finalize swaps a reserveBatch placeholder for volumeID, the volume's real attach ID.
+func (t *nodeVolumeLimitTracker) finalize(nodeName, placeholder, volumeID string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	delete(t.attached[nodeName], placeholder)
+	t.attached[nodeName][volumeID] = true
+}
+
+// nextAvailableNodeSelector round-robins nodeSelectorList from *index, atomically reserving a batch of n slots on the first node with room, or ok=false if none have enough.
+func nextAvailableNodeSelector(nodeSelectorList []*NodeSelector, tracker *nodeVolumeLimitTracker, index *int, n int) (*NodeSelector, []string, bool) {
+	for attempts := 0; attempts < len(nodeSelectorList); attempts++ {
+		nodeSelector := nodeSelectorList[*index%len(nodeSelectorList)]
+		*index++
+		if placeholders, ok := tracker.reserveBatch(nodeSelector.nodeName, n); ok {
+			return nodeSelector, placeholders, true
+		}
+	}
+	return nil, nil, false
 }
 
 var _ = SIGDescribe("vcp at scale [Feature:vsphere] ", func() {
 	f := framework.NewDefaultFramework("vcp-at-scale")
 
 	var (
-		client            clientset.Interface
-		namespace         string
-		nodeSelectorList  []*NodeSelector
-		volumeCount       int
-		numberOfInstances int
-		volumesPerPod     int
-		nodeVolumeMapChan chan map[string][]string
-		nodes             *v1.NodeList
-		policyName        string
-		datastoreName     string
-		scNames           = []string{storageclass1, storageclass2, storageclass3, storageclass4}
-		err               error
+		client             clientset.Interface
+		namespace          string
+		nodeSelectorList   []*NodeSelector
+		volumeCount        int
+		numberOfInstances  int
+		volumesPerPod      int
+		nodeVolumeMapChan  chan map[string][]string
+		nodes              *v1.NodeList
+		policyName         string
+		datastoreName      string
+		scNames            = []string{storageclass1, storageclass2, storageclass3, storageclass4}
+		volumeLimitTracker *nodeVolumeLimitTracker
+		useCSIDriver       bool
+		driver             ScaleDriver
+		err                error
 	)
 
 	BeforeEach(func() {
@@ -99,13 +409,19 @@ var _ = SIGDescribe("vcp at scale [Feature:vsphere] ", func() {
 		Expect(policyName).NotTo(BeEmpty(), "ENV VSPHERE_SPBM_POLICY_NAME is not set")
 		Expect(datastoreName).NotTo(BeEmpty(), "ENV VSPHERE_DATASTORE is not set")
 
+		// VCP_SCALE_USE_CSI opts the scale test into provisioning through a CSI driver
+		useCSIDriver = os.Getenv("VCP_SCALE_USE_CSI") == "true"
+		driver, err = newScaleDriver(client, useCSIDriver, policyName, datastoreName)
+		Expect(err).NotTo(HaveOccurred())
+
 		nodes = framework.GetReadySchedulableNodesOrDie(client)
 		if len(nodes.Items) < 2 {
 			framework.Skipf("Requires at least %d nodes (not %d)", 2, len(nodes.Items))
 		}
 		// Verify volume count specified by the user can be satisfied
-		if volumeCount > volumesPerNode*len(nodes.Items) {
-			framework.Skipf("Cannot attach %d volumes to %d nodes. Maximum volumes that can be attached on %d nodes is %d", volumeCount, len(nodes.Items), len(nodes.Items), volumesPerNode*len(nodes.Items))
+		volumeLimitTracker = newNodeVolumeLimitTracker(nodes, driver)
+		if volumeCount > volumeLimitTracker.totalCapacity() {
+			framework.Skipf("Cannot attach %d volumes to %d nodes. Maximum volumes that can be attached on %d nodes is %d", volumeCount, len(nodes.Items), len(nodes.Items), volumeLimitTracker.totalCapacity())
 		}
 		nodeSelectorList = createNodeLabels(client, namespace, nodes)
 	})
@@ -120,82 +436,200 @@ var _ = SIGDescribe("vcp at scale [Feature:vsphere] ", func() {
 	})
 
 	It("vsphere scale tests", func() {
-		var pvcClaimList []string
-		nodeVolumeMap := make(map[k8stypes.NodeName][]string)
-		// Volumes will be provisioned with each different types of Storage Class
-		scArrays := make([]*storageV1.StorageClass, len(scNames))
-		for index, scname := range scNames {
-			// Create vSphere Storage Class
-			By(fmt.Sprintf("Creating Storage Class : %q", scname))
-			var sc *storageV1.StorageClass
-			scParams := make(map[string]string)
-			var err error
-			switch scname {
-			case storageclass1:
-				scParams = nil
-			case storageclass2:
-				scParams[Policy_HostFailuresToTolerate] = "1"
-			case storageclass3:
-				scParams[SpbmStoragePolicy] = policyName
-			case storageclass4:
-				scParams[Datastore] = datastoreName
-			}
-			sc, err = client.StorageV1().StorageClasses().Create(getVSphereStorageClassSpec(scname, scParams))
-			Expect(sc).NotTo(BeNil(), "Storage class is empty")
-			Expect(err).NotTo(HaveOccurred(), "Failed to create storage class")
-			defer client.StorageV1().StorageClasses().Delete(scname, nil)
-			scArrays[index] = sc
+		scArrays := createStorageClasses(client, driver.BuildStorageClasses(scNames))
+		for _, sc := range scArrays {
+			defer client.StorageV1().StorageClasses().Delete(sc.Name, nil)
 		}
 
-		vsp, err := vsphere.GetVSphere()
+		nodeVolumeMap := runScaleVolumeCreateAndAttach(client, namespace, scArrays, volumeCount, numberOfInstances, volumesPerPod, nodeSelectorList, volumeLimitTracker, driver, nil, nodeVolumeMapChan)
+
+		_, err := cleanupScaleTestPods(f, client, namespace, volumesPerPod, nodeVolumeMap, driver)
 		Expect(err).NotTo(HaveOccurred())
+	})
 
-		volumeCountPerInstance := volumeCount / numberOfInstances
-		for instanceCount := 0; instanceCount < numberOfInstances; instanceCount++ {
-			if instanceCount == numberOfInstances-1 {
-				volumeCountPerInstance = volumeCount
-			}
-			volumeCount = volumeCount - volumeCountPerInstance
-			go VolumeCreateAndAttach(client, namespace, scArrays, volumeCountPerInstance, volumesPerPod, nodeSelectorList, nodeVolumeMapChan, vsp)
+	It("vsphere scale tests with backup selection policies", func() {
+		backupAnnotationFraction := 0.5
+		if fractionStr := os.Getenv("VCP_SCALE_BACKUP_ANNOTATION_FRACTION"); fractionStr != "" {
+			backupAnnotationFraction, err = strconv.ParseFloat(fractionStr, 64)
+			Expect(err).NotTo(HaveOccurred(), "Error Parsing VCP_SCALE_BACKUP_ANNOTATION_FRACTION")
 		}
+		backupAnnotator := &podBackupAnnotator{fraction: backupAnnotationFraction}
 
-		// Get the list of all volumes attached to each node from the go routines by reading the data from the channel
-		for instanceCount := 0; instanceCount < numberOfInstances; instanceCount++ {
-			for node, volumeList := range <-nodeVolumeMapChan {
-				nodeVolumeMap[k8stypes.NodeName(node)] = append(nodeVolumeMap[k8stypes.NodeName(node)], volumeList...)
-			}
+		scArrays := createStorageClasses(client, driver.BuildStorageClasses(scNames))
+		for _, sc := range scArrays {
+			defer client.StorageV1().StorageClasses().Delete(sc.Name, nil)
 		}
+
+		nodeVolumeMap := runScaleVolumeCreateAndAttach(client, namespace, scArrays, volumeCount, numberOfInstances, volumesPerPod, nodeSelectorList, volumeLimitTracker, driver, backupAnnotator, nodeVolumeMapChan)
+
+		By("Recording which PVCs each backup selection policy would back up")
 		podList, err := client.CoreV1().Pods(namespace).List(metav1.ListOptions{})
+		Expect(err).NotTo(HaveOccurred())
 		for _, pod := range podList.Items {
-			pvcClaimList = append(pvcClaimList, getClaimsForPod(&pod, volumesPerPod)...)
-			By("Deleting pod")
-			err = framework.DeletePodWithWait(f, client, &pod)
-			Expect(err).NotTo(HaveOccurred())
+			allClaims := getClaimsForPod(&pod)
+			selectedClaims := getBackupSelectedClaims(&pod)
+			switch {
+			case pod.Annotations[backupIncludeVolumesAnnotation] != "":
+				Expect(len(selectedClaims)).To(Equal(1), "opt-in annotation should select exactly the named volume's claim")
+			case pod.Annotations[backupExcludeVolumesAnnotation] != "":
+				Expect(len(selectedClaims)).To(Equal(len(allClaims)-1), "opt-out annotation should select every claim but the named volume's")
+			default:
+				Expect(selectedClaims).To(ConsistOf(allClaims), "pods without a selection annotation should have every claim selected")
+			}
 		}
-		By("Waiting for volumes to be detached from the node")
-		err = waitForVSphereDisksToDetach(vsp, nodeVolumeMap)
-		Expect(err).NotTo(HaveOccurred())
+		manifestPath := filepath.Join(framework.TestContext.ReportDir, fmt.Sprintf("vcp-scale-backup-selection-%s.tsv", namespace))
+		Expect(writeBackupSelectionManifest(manifestPath, podList)).To(Succeed())
+		By(fmt.Sprintf("Wrote backup selection manifest to %q", manifestPath))
 
-		for _, pvcClaim := range pvcClaimList {
-			err = framework.DeletePersistentVolumeClaim(client, pvcClaim, namespace)
-			Expect(err).NotTo(HaveOccurred())
-		}
+		_, err = cleanupScaleTestPods(f, client, namespace, volumesPerPod, nodeVolumeMap, driver)
+		Expect(err).NotTo(HaveOccurred())
 	})
 })
 
 // Get PVC claims for the pod
-func getClaimsForPod(pod *v1.Pod, volumesPerPod int) []string {
-	pvcClaimList := make([]string, volumesPerPod)
-	for i, volumespec := range pod.Spec.Volumes {
+func getClaimsForPod(pod *v1.Pod) []string {
+	var pvcClaimList []string
+	for _, volumespec := range pod.Spec.Volumes {
 		if volumespec.PersistentVolumeClaim != nil {
-			pvcClaimList[i] = volumespec.PersistentVolumeClaim.ClaimName
+			pvcClaimList = append(pvcClaimList, volumespec.PersistentVolumeClaim.ClaimName)
 		}
 	}
 	return pvcClaimList
 }
 
+// velero's opt-in/opt-out volume-selection annotations.
+const (
+	backupIncludeVolumesAnnotation = "backup.velero.io/backup-volumes"
+	backupExcludeVolumesAnnotation = "backup.velero.io/backup-volumes-excludes"
+)
+
+// getBackupSelectedClaims returns the PVC claim names selected for backup under pod's opt-in/opt-out annotation, if any.
+func getBackupSelectedClaims(pod *v1.Pod) []string {
+	include := sets.NewString(strings.Split(pod.Annotations[backupIncludeVolumesAnnotation], ",")...)
+	exclude := sets.NewString(strings.Split(pod.Annotations[backupExcludeVolumesAnnotation], ",")...)
+
+	var claims []string
+	for _, volumespec := range pod.Spec.Volumes {
+		if volumespec.PersistentVolumeClaim == nil {
+			continue
+		}
+		switch {
+		case pod.Annotations[backupIncludeVolumesAnnotation] != "":
+			if !include.Has(volumespec.Name) {
+				continue
+			}
+		case pod.Annotations[backupExcludeVolumesAnnotation] != "":
+			if exclude.Has(volumespec.Name) {
+				continue
+			}
+		}
+		claims = append(claims, volumespec.PersistentVolumeClaim.ClaimName)
+	}
+	return claims
+}
+
+// writeBackupSelectionManifest records which PVCs each pod in podList would have backed up versus skipped.
+func writeBackupSelectionManifest(path string, podList *v1.PodList) error {
+	var manifest strings.Builder
+	for _, pod := range podList.Items {
+		selected := sets.NewString(getBackupSelectedClaims(&pod)...)
+		for _, claim := range getClaimsForPod(&pod) {
+			status := "skipped"
+			if selected.Has(claim) {
+				status = "backed-up"
+			}
+			fmt.Fprintf(&manifest, "%s\t%s\t%s\n", pod.Name, claim, status)
+		}
+	}
+	return ioutil.WriteFile(path, []byte(manifest.String()), 0644)
+}
+
+// podBackupAnnotator randomly applies a backup-volume annotation to a fraction of pods. A nil *podBackupAnnotator leaves pods unannotated.
+type podBackupAnnotator struct {
+	fraction float64
+}
+
+// annotate randomly applies an opt-in or opt-out annotation naming the pod's first volume, with probability a.fraction, and reports whether it changed the pod.
+func (a *podBackupAnnotator) annotate(pod *v1.Pod) bool {
+	if a == nil || len(pod.Spec.Volumes) == 0 || mathrand.Float64() > a.fraction {
+		return false
+	}
+	if pod.Annotations == nil {
+		pod.Annotations = make(map[string]string)
+	}
+	firstVolume := pod.Spec.Volumes[0].Name
+	if mathrand.Intn(2) == 0 {
+		pod.Annotations[backupIncludeVolumesAnnotation] = firstVolume
+	} else {
+		pod.Annotations[backupExcludeVolumesAnnotation] = firstVolume
+	}
+	return true
+}
+
+// createStorageClasses creates each given storage class spec, returning the created objects for the caller to clean up.
+func createStorageClasses(client clientset.Interface, scSpecs []*storageV1.StorageClass) []*storageV1.StorageClass {
+	scArrays := make([]*storageV1.StorageClass, len(scSpecs))
+	for index, scSpec := range scSpecs {
+		By(fmt.Sprintf("Creating Storage Class : %q", scSpec.Name))
+		sc, err := client.StorageV1().StorageClasses().Create(scSpec)
+		Expect(sc).NotTo(BeNil(), "Storage class is empty")
+		Expect(err).NotTo(HaveOccurred(), "Failed to create storage class")
+		scArrays[index] = sc
+	}
+	return scArrays
+}
+
+// runScaleVolumeCreateAndAttach fans volumeCount volumes out across numberOfInstances goroutines and collects their per-node volumes from nodeVolumeMapChan.
+func runScaleVolumeCreateAndAttach(client clientset.Interface, namespace string, scArrays []*storageV1.StorageClass, volumeCount, numberOfInstances, volumesPerPod int, nodeSelectorList []*NodeSelector, volumeLimitTracker *nodeVolumeLimitTracker, driver ScaleDriver, backupAnnotator *podBackupAnnotator, nodeVolumeMapChan chan map[string][]string) map[k8stypes.NodeName][]string {
+	volumeCountPerInstance := volumeCount / numberOfInstances
+	for instanceCount := 0; instanceCount < numberOfInstances; instanceCount++ {
+		if instanceCount == numberOfInstances-1 {
+			volumeCountPerInstance = volumeCount
+		}
+		volumeCount = volumeCount - volumeCountPerInstance
+		go VolumeCreateAndAttach(client, namespace, scArrays, volumeCountPerInstance, volumesPerPod, nodeSelectorList, nodeVolumeMapChan, driver, volumeLimitTracker, backupAnnotator)
+	}
+
+	// Get the list of all volumes attached to each node from the go routines by reading the data from the channel
+	nodeVolumeMap := make(map[k8stypes.NodeName][]string)
+	for instanceCount := 0; instanceCount < numberOfInstances; instanceCount++ {
+		for node, volumeList := range <-nodeVolumeMapChan {
+			nodeVolumeMap[k8stypes.NodeName(node)] = append(nodeVolumeMap[k8stypes.NodeName(node)], volumeList...)
+		}
+	}
+	return nodeVolumeMap
+}
+
+// cleanupScaleTestPods deletes every pod in namespace, waits for their volumes to detach, then deletes the PVCs, returning the deleted pods.
+func cleanupScaleTestPods(f *framework.Framework, client clientset.Interface, namespace string, volumesPerPod int, nodeVolumeMap map[k8stypes.NodeName][]string, driver ScaleDriver) (*v1.PodList, error) {
+	podList, err := client.CoreV1().Pods(namespace).List(metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	var pvcClaimList []string
+	for _, pod := range podList.Items {
+		pvcClaimList = append(pvcClaimList, getClaimsForPod(&pod)...)
+		By("Deleting pod")
+		if err := framework.DeletePodWithWait(f, client, &pod); err != nil {
+			return podList, err
+		}
+	}
+
+	By("Waiting for volumes to be detached from the node")
+	if err := driver.WaitForDisksDetached(nodeVolumeMap); err != nil {
+		return podList, err
+	}
+
+	for _, pvcClaim := range pvcClaimList {
+		if err := framework.DeletePersistentVolumeClaim(client, pvcClaim, namespace); err != nil {
+			return podList, err
+		}
+	}
+	return podList, nil
+}
+
 // VolumeCreateAndAttach peforms create and attach operations of vSphere persistent volumes at scale
-func VolumeCreateAndAttach(client clientset.Interface, namespace string, sc []*storageV1.StorageClass, volumeCountPerInstance int, volumesPerPod int, nodeSelectorList []*NodeSelector, nodeVolumeMapChan chan map[string][]string, vsp *vsphere.VSphere) {
+func VolumeCreateAndAttach(client clientset.Interface, namespace string, sc []*storageV1.StorageClass, volumeCountPerInstance int, volumesPerPod int, nodeSelectorList []*NodeSelector, nodeVolumeMapChan chan map[string][]string, driver ScaleDriver, volumeLimitTracker *nodeVolumeLimitTracker, backupAnnotator *podBackupAnnotator) {
 	defer GinkgoRecover()
 	nodeVolumeMap := make(map[string][]string)
 	nodeSelectorIndex := 0
@@ -203,6 +637,13 @@ func VolumeCreateAndAttach(client clientset.Interface, namespace string, sc []*s
 		if (volumeCountPerInstance - index) < volumesPerPod {
 			volumesPerPod = volumeCountPerInstance - index
 		}
+
+		nodeSelector, placeholders, ok := nextAvailableNodeSelector(nodeSelectorList, volumeLimitTracker, &nodeSelectorIndex, volumesPerPod)
+		if !ok {
+			By("Skipping remaining volumes, no node has room for this pod's volumes under its reported attach limit")
+			break
+		}
+
 		pvclaims := make([]*v1.PersistentVolumeClaim, volumesPerPod)
 		for i := 0; i < volumesPerPod; i++ {
 			By("Creating PVC using the Storage Class")
@@ -216,17 +657,22 @@ func VolumeCreateAndAttach(client clientset.Interface, namespace string, sc []*s
 		Expect(err).NotTo(HaveOccurred())
 
 		By("Creating pod to attach PV to the node")
-		nodeSelector := nodeSelectorList[nodeSelectorIndex%len(nodeSelectorList)]
 		// Create pod to attach Volume to Node
 		pod, err := framework.CreatePod(client, namespace, map[string]string{nodeSelector.labelKey: nodeSelector.labelValue}, pvclaims, false, "")
 		Expect(err).NotTo(HaveOccurred())
 
-		for _, pv := range persistentvolumes {
-			nodeVolumeMap[pod.Spec.NodeName] = append(nodeVolumeMap[pod.Spec.NodeName], pv.Spec.VsphereVolume.VolumePath)
+		if backupAnnotator.annotate(pod) {
+			pod, err = client.CoreV1().Pods(namespace).Update(pod)
+			Expect(err).NotTo(HaveOccurred())
+		}
+
+		for i, pv := range persistentvolumes {
+			volumeHandle := driver.ResolveVolumeHandle(pv)
+			nodeVolumeMap[pod.Spec.NodeName] = append(nodeVolumeMap[pod.Spec.NodeName], volumeHandle)
+			volumeLimitTracker.finalize(nodeSelector.nodeName, placeholders[i], volumeAttachID(sc[index%len(sc)].Provisioner, pv, volumeHandle, pvclaims[i].UID))
 		}
 		By("Verify the volume is accessible and available in the pod")
-		verifyVSphereVolumesAccessible(pod, persistentvolumes, vsp)
-		nodeSelectorIndex++
+		driver.VerifyVolumesAccessible(pod, persistentvolumes)
 	}
 	nodeVolumeMapChan <- nodeVolumeMap
 	close(nodeVolumeMapChan)
@@ -239,6 +685,7 @@ func createNodeLabels(client clientset.Interface, namespace string, nodes *v1.No
 		nodeSelector := &NodeSelector{
 			labelKey:   NodeLabelKey,
 			labelValue: labelVal,
+			nodeName:   node.Name,
 		}
 		nodeSelectorList = append(nodeSelectorList, nodeSelector)
 		framework.AddOrUpdateLabelOnNode(client, node.Name, NodeLabelKey, labelVal)